@@ -0,0 +1,104 @@
+// Package controlpb implements the wire types and gRPC client described by control.proto.
+//
+// These are checked in by hand rather than produced by `protoc --go_out=. --go-grpc_out=.
+// control.proto` because this checkout has no protobuf toolchain available; control.proto
+// remains the canonical definition and `go generate` should replace this file with real
+// protoc-gen-go/protoc-gen-go-grpc output the next time the toolchain is available. In the
+// meantime the client below talks a real bidirectional gRPC stream, just encoded with a small
+// JSON codec instead of the protobuf wire format, so ControlMessage stays a plain Go struct.
+package controlpb
+
+//go:generate protoc --go_out=. --go-grpc_out=. control.proto
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// ControlMessage_Type - mirrors the `Type` enum in control.proto
+type ControlMessage_Type int32
+
+const (
+	ControlMessage_PUBLISH   ControlMessage_Type = 0
+	ControlMessage_SUBSCRIBE ControlMessage_Type = 1
+	ControlMessage_ACK       ControlMessage_Type = 2
+)
+
+// ControlMessage - mirrors the `ControlMessage` message in control.proto
+type ControlMessage struct {
+	Type     ControlMessage_Type `json:"type"`
+	Topic    string              `json:"topic"`
+	Payload  []byte              `json:"payload"`
+	Retained bool                `json:"retained"`
+}
+
+// controlJSONCodec - name "json" registered with grpc's encoding package and forced via
+// grpc.ForceCodec on every Control client call, so ControlMessage doesn't need to implement
+// proto.Message.
+type controlJSONCodec struct{}
+
+func (controlJSONCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+func (controlJSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+func (controlJSONCodec) Name() string { return "json" }
+
+func init() {
+	encoding.RegisterCodec(controlJSONCodec{})
+}
+
+// ControlClient - matches the `Control` service in control.proto
+type ControlClient interface {
+	Stream(ctx context.Context, opts ...grpc.CallOption) (Control_StreamClient, error)
+}
+
+// Control_StreamClient - the client side of the bidirectional Stream RPC
+type Control_StreamClient interface {
+	Send(*ControlMessage) error
+	Recv() (*ControlMessage, error)
+	grpc.ClientStream
+}
+
+type controlClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewControlClient - builds a ControlClient over an existing gRPC connection
+func NewControlClient(cc grpc.ClientConnInterface) ControlClient {
+	return &controlClient{cc: cc}
+}
+
+var controlStreamDesc = grpc.StreamDesc{
+	StreamName:    "Stream",
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+func (c *controlClient) Stream(ctx context.Context, opts ...grpc.CallOption) (Control_StreamClient, error) {
+	opts = append(opts, grpc.ForceCodec(controlJSONCodec{}))
+	stream, err := c.cc.NewStream(ctx, &controlStreamDesc, "/controlpb.Control/Stream", opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error opening control stream: %w", err)
+	}
+	return &controlStreamClient{stream}, nil
+}
+
+type controlStreamClient struct {
+	grpc.ClientStream
+}
+
+func (s *controlStreamClient) Send(m *ControlMessage) error {
+	return s.ClientStream.SendMsg(m)
+}
+
+func (s *controlStreamClient) Recv() (*ControlMessage, error) {
+	m := new(ControlMessage)
+	if err := s.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
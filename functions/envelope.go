@@ -0,0 +1,206 @@
+package functions
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gravitl/netclient/config"
+	"golang.org/x/exp/slog"
+)
+
+// envelopeSchemaVersion - current version of the msgEnvelope wire format
+const envelopeSchemaVersion = 1
+
+// defaultAllowedClockSkew - how far a message's timestamp may drift from now before it is
+// rejected, used when a server has no explicit override.
+const defaultAllowedClockSkew = 5 * time.Minute
+
+// allowedClockSkew - the timestamp/nonce skew window for serverName, overridable per-server via
+// config.Server.ClockSkew so operators with clock-drifted fleets aren't stuck with the default.
+func allowedClockSkew(serverName string) time.Duration {
+	if server := config.GetServer(serverName); server != nil && server.ClockSkew > 0 {
+		return server.ClockSkew
+	}
+	return defaultAllowedClockSkew
+}
+
+// msgEnvelope - signed, versioned wrapper around every MQTT payload delivered to
+// NodeUpdate, HostPeerUpdate and HostUpdate. It lets the client detect replayed
+// retained messages and tolerate future breaking changes to the inner payload.
+type msgEnvelope struct {
+	Version    int    `json:"version"`
+	Timestamp  int64  `json:"timestamp"`
+	Nonce      string `json:"nonce"`
+	Seq        uint64 `json:"seq"`
+	Signature  string `json:"signature"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// lastAcceptedSeq - highest accepted sequence number per server+topic, guarding against replay.
+// Lazily hydrated from the persisted config.Server.LastSeqByTopic the first time a given
+// server+topic is seen, so the floor survives a daemon restart instead of resetting to zero.
+var (
+	lastAcceptedSeqMu sync.Mutex
+	lastAcceptedSeq   = map[string]uint64{}
+)
+
+// seenNonces - nonces accepted within the current skew window, per server+topic+nonce, so a
+// broker cannot re-wrap an old ciphertext under a fresh timestamp/seq and have it accepted twice
+// within that window. Entries are purged once they age out of the server's allowedClockSkew.
+var (
+	seenNoncesMu sync.Mutex
+	seenNonces   = map[string]time.Time{}
+)
+
+// unwrapEnvelope - validates and decrypts an incoming envelope for the given server/topic,
+// returning the decrypted payload bytes ready for json.Unmarshal into the caller's model.
+func unwrapEnvelope(serverName, topic string, raw []byte) ([]byte, error) {
+	var envelope msgEnvelope
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return nil, fmt.Errorf("error unmarshalling envelope: %w", err)
+	}
+	if envelope.Version != envelopeSchemaVersion {
+		return nil, fmt.Errorf("unsupported envelope schema version %d", envelope.Version)
+	}
+	skewWindow := allowedClockSkew(serverName)
+	ts := time.Unix(envelope.Timestamp, 0)
+	if skew := time.Since(ts); skew > skewWindow || skew < -skewWindow {
+		return nil, fmt.Errorf("envelope timestamp %s outside allowed skew window", ts)
+	}
+	if envelope.Nonce == "" {
+		return nil, fmt.Errorf("envelope missing nonce")
+	}
+	// Only a read here: an unauthenticated envelope must not be able to poison the nonce cache
+	// for this server+topic, so the nonce is recorded as seen below, only once its signature
+	// has actually verified.
+	if nonceAlreadySeen(serverName, topic, envelope.Nonce) {
+		return nil, fmt.Errorf("envelope nonce %q already seen for topic %s", envelope.Nonce, topic)
+	}
+	if !seqIsFresh(serverName, topic, envelope.Seq) {
+		return nil, fmt.Errorf("envelope seq %d is not newer than last accepted seq for topic %s", envelope.Seq, topic)
+	}
+	server := config.GetServer(serverName)
+	if server == nil {
+		return nil, fmt.Errorf("server %s not found in config", serverName)
+	}
+	if err := verifyEnvelopeSignature(server, &envelope); err != nil {
+		return nil, fmt.Errorf("error verifying envelope signature: %w", err)
+	}
+	recordNonceSeen(serverName, topic, envelope.Nonce, ts, skewWindow)
+	ciphertext, err := base64.StdEncoding.DecodeString(envelope.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding envelope ciphertext: %w", err)
+	}
+	data, err := decryptMsg(serverName, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	commitSeq(serverName, topic, envelope.Seq)
+	return []byte(data), nil
+}
+
+// seqIsFresh - reports whether seq is strictly greater than the last accepted seq for
+// server/topic, hydrating the in-memory floor from the persisted config value on first use.
+func seqIsFresh(serverName, topic string, seq uint64) bool {
+	lastAcceptedSeqMu.Lock()
+	defer lastAcceptedSeqMu.Unlock()
+	key := serverName + "|" + topic
+	if _, ok := lastAcceptedSeq[key]; !ok {
+		lastAcceptedSeq[key] = persistedSeq(serverName, topic)
+	}
+	return seq > lastAcceptedSeq[key]
+}
+
+// persistedSeq - reads the last-accepted seq for server/topic out of the on-disk server config
+func persistedSeq(serverName, topic string) uint64 {
+	server := config.GetServer(serverName)
+	if server == nil || server.LastSeqByTopic == nil {
+		return 0
+	}
+	return server.LastSeqByTopic[topic]
+}
+
+// nonceAlreadySeen - reports whether nonce was already accepted for server/topic within the
+// current skew window. Read-only: does not record nonce, since that must wait until the
+// envelope carrying it has passed signature verification (see recordNonceSeen).
+func nonceAlreadySeen(serverName, topic, nonce string) bool {
+	seenNoncesMu.Lock()
+	defer seenNoncesMu.Unlock()
+	_, seen := seenNonces[serverName+"|"+topic+"|"+nonce]
+	return seen
+}
+
+// recordNonceSeen - records nonce as accepted for server/topic until it ages out of skewWindow,
+// and opportunistically purges expired entries. Callers must only invoke this after the envelope
+// carrying nonce has passed signature verification, so a forged message can't poison the cache
+// and block a legitimate later delivery of the same nonce.
+func recordNonceSeen(serverName, topic, nonce string, ts time.Time, skewWindow time.Duration) {
+	seenNoncesMu.Lock()
+	defer seenNoncesMu.Unlock()
+	seenNonces[serverName+"|"+topic+"|"+nonce] = ts.Add(skewWindow)
+	purgeExpiredNoncesLocked()
+}
+
+// purgeExpiredNoncesLocked - drops nonce entries older than the skew window; caller must hold seenNoncesMu
+func purgeExpiredNoncesLocked() {
+	now := time.Now()
+	for key, expiry := range seenNonces {
+		if now.After(expiry) {
+			delete(seenNonces, key)
+		}
+	}
+}
+
+// commitSeq - records seq as the last accepted sequence number for server/topic and persists it
+func commitSeq(serverName, topic string, seq uint64) {
+	lastAcceptedSeqMu.Lock()
+	key := serverName + "|" + topic
+	lastAcceptedSeq[key] = seq
+	lastAcceptedSeqMu.Unlock()
+	server := config.GetServer(serverName)
+	if server == nil {
+		return
+	}
+	if server.LastSeqByTopic == nil {
+		server.LastSeqByTopic = map[string]uint64{}
+	}
+	server.LastSeqByTopic[topic] = seq
+	config.UpdateServer(serverName, *server)
+	if err := config.WriteServerConfig(); err != nil {
+		slog.Warn("failed to persist envelope sequence state", "server", serverName, "topic", topic, "error", err)
+	}
+}
+
+// verifyEnvelopeSignature - checks the Ed25519 signature over the envelope's signed fields
+// against the server's known public key, fetched at join time and stored in config.Server.
+func verifyEnvelopeSignature(server *config.Server, envelope *msgEnvelope) error {
+	if len(server.ControlPubKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("no valid control pubkey stored for server %s", server.Name)
+	}
+	sig, err := base64.StdEncoding.DecodeString(envelope.Signature)
+	if err != nil {
+		return fmt.Errorf("error decoding signature: %w", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(server.ControlPubKey), envelopeSigningPayload(envelope), sig) {
+		return fmt.Errorf("signature verification failed")
+	}
+	return nil
+}
+
+// envelopeSigningPayload - canonical byte serialization of every field that must be
+// authenticated, so a party holding a previously-signed ciphertext cannot re-wrap it under a
+// fresh timestamp/seq/nonce and have the original signature still verify.
+func envelopeSigningPayload(envelope *msgEnvelope) []byte {
+	buf := make([]byte, 0, 20+len(envelope.Nonce)+len(envelope.Ciphertext))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(envelope.Version))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(envelope.Timestamp))
+	buf = binary.BigEndian.AppendUint64(buf, envelope.Seq)
+	buf = append(buf, []byte(envelope.Nonce)...)
+	buf = append(buf, []byte(envelope.Ciphertext)...)
+	return buf
+}
@@ -0,0 +1,74 @@
+package functions
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/metrics"
+	"github.com/gravitl/netclient/wireguard"
+	"golang.org/x/exp/slog"
+)
+
+// lastFallbackPullMu / lastFallbackPull - timestamp of the most recent successful mqFallback
+// pull, surfaced on the /status endpoint as Status.LastFallbackPull.
+var (
+	lastFallbackPullMu sync.Mutex
+	lastFallbackPull   time.Time
+)
+
+// metricsServerOnce - setupMQTT calls StartMetricsServer on every (re)connect, so guard the
+// actual bind with a sync.Once rather than trying to rebind (and log a spurious error) each time.
+var metricsServerOnce sync.Once
+
+// recordFallbackPull - records now as the last successful fallback pull time
+func recordFallbackPull(now time.Time) {
+	lastFallbackPullMu.Lock()
+	lastFallbackPull = now
+	lastFallbackPullMu.Unlock()
+}
+
+// StartMetricsServer - binds the Prometheus /metrics and JSON /status endpoints on loopback, at
+// the port the operator configured (config.Netclient().MetricsPort), defaulting to 0 (disabled).
+// Safe to call on every setupMQTT (re)connect: the actual bind only ever happens once.
+func StartMetricsServer() {
+	metricsServerOnce.Do(func() {
+		port := config.Netclient().MetricsPort
+		if port == 0 {
+			return
+		}
+		if _, err := metrics.StartServer(port, buildStatus); err != nil {
+			slog.Error("failed to start metrics server", "port", port, "error", err)
+		}
+	})
+}
+
+// buildStatus - snapshots current MQTT connectivity and per-peer wgctrl stats for /status
+func buildStatus() metrics.Status {
+	lastFallbackPullMu.Lock()
+	status := metrics.Status{
+		MQTTConnected:    Mqclient != nil && Mqclient.IsConnectionOpen() && Mqclient.IsConnected(),
+		LastFallbackPull: lastFallbackPull,
+	}
+	lastFallbackPullMu.Unlock()
+	device, err := wireguard.GetInterface().Device()
+	if err != nil {
+		slog.Warn("failed to read wireguard device for status endpoint", "error", err)
+		return status
+	}
+	for _, peer := range device.Peers {
+		status.Peers = append(status.Peers, metrics.PeerStatus{
+			PublicKey:     peer.PublicKey.String(),
+			LastHandshake: peer.LastHandshakeTime,
+			RxBytes:       peer.ReceiveBytes,
+			TxBytes:       peer.TransmitBytes,
+		})
+		pubKey := peer.PublicKey.String()
+		metrics.PeerBytes.WithLabelValues(pubKey, "rx").Set(float64(peer.ReceiveBytes))
+		metrics.PeerBytes.WithLabelValues(pubKey, "tx").Set(float64(peer.TransmitBytes))
+		if !peer.LastHandshakeTime.IsZero() {
+			metrics.PeerHandshakeAge.WithLabelValues(pubKey).Set(time.Since(peer.LastHandshakeTime).Seconds())
+		}
+	}
+	return status
+}
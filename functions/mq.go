@@ -0,0 +1,65 @@
+package functions
+
+import (
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/metrics"
+	"golang.org/x/exp/slog"
+)
+
+// Mqclient - the active MQTT client connection to config.CurrServer's broker. Set by setupMQTT
+// and read throughout functions (mqFallback, buildStatus) to decide whether MQTT is still usable.
+var Mqclient mqtt.Client
+
+// mqttSubscriptions - topic patterns the live MQTT client subscribes to on every (re)connect.
+// Kept separate from controlTopicHandlers (transport.go), which drives the same dispatch over a
+// gRPC fallback transport, since the two need to register through different client APIs.
+var mqttSubscriptions = []struct {
+	topic   string
+	handler mqtt.MessageHandler
+}{
+	{"update/#", NodeUpdate},
+	{"peers/host/#", HostPeerUpdate},
+	{"peers/host/delta/#", HostPeerDelta},
+	{"host/update/#", HostUpdate},
+	{"signal/#", PeerCandidates},
+}
+
+// setupMQTT - dials server's broker, subscribes every topic in mqttSubscriptions, and sets
+// Mqclient to the resulting client. Called at daemon startup for each configured server, and
+// re-invoked by raceTransports whenever the broker connection needs to be (re)established.
+func setupMQTT(server *config.Server) error {
+	StartMetricsServer()
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(server.Broker)
+	opts.SetClientID(server.MQID)
+	opts.SetDefaultPublishHandler(All)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectTimeout(MQTimeout * time.Second)
+	opts.SetOnConnectHandler(onMQTTConnect)
+	opts.SetConnectionLostHandler(OnMQTTConnectionLost)
+	client := mqtt.NewClient(opts)
+	if tok := client.Connect(); tok.Wait() && tok.Error() != nil {
+		return fmt.Errorf("error connecting to broker %s: %w", server.Broker, tok.Error())
+	}
+	Mqclient = client
+	return nil
+}
+
+// onMQTTConnect - subscribes every topic in mqttSubscriptions, at its TopicPolicy QoS, on
+// (re)connect, so a broker reconnect (whether from AutoReconnect or a fresh setupMQTT call)
+// always re-establishes the full set of handlers instead of relying on subscriptions surviving
+// the drop. Also counts the connect itself, so MQTTConnects reflects normal reconnects and not
+// just the ones that happen to win a fallback race.
+func onMQTTConnect(client mqtt.Client) {
+	metrics.MQTTConnects.Inc()
+	for _, s := range mqttSubscriptions {
+		policy := GetTopicPolicy(s.topic)
+		if tok := client.Subscribe(s.topic, policy.QoS, s.handler); tok.Wait() && tok.Error() != nil {
+			slog.Error("failed to subscribe to mqtt topic", "topic", s.topic, "error", tok.Error())
+		}
+	}
+}
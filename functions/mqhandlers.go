@@ -3,6 +3,7 @@ package functions
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net"
 	"strings"
 	"sync"
@@ -12,7 +13,7 @@ import (
 	"github.com/gravitl/netclient/config"
 	"github.com/gravitl/netclient/daemon"
 	"github.com/gravitl/netclient/firewall"
-	"github.com/gravitl/netclient/ncutils"
+	"github.com/gravitl/netclient/metrics"
 	"github.com/gravitl/netclient/networking"
 	"github.com/gravitl/netclient/wireguard"
 	"github.com/gravitl/netmaker/models"
@@ -28,17 +29,27 @@ var All mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
 	slog.Info("default message handler -- received message but not handling", "topic", msg.Topic())
 }
 
+// OnMQTTConnectionLost - set as mqtt.ClientOptions.OnConnectionLost in setupMQTT, so every
+// broker disconnect is counted alongside metrics.MQTTConnects.
+var OnMQTTConnectionLost mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
+	slog.Warn("mqtt connection lost", "error", err)
+	metrics.MQTTDisconnects.Inc()
+}
+
 // NodeUpdate -- mqtt message handler for /update/<NodeID> topic
 func NodeUpdate(client mqtt.Client, msg mqtt.Message) {
+	defer metrics.ObserveHandlerLatency("NodeUpdate", time.Now())
 	network := parseNetworkFromTopic(msg.Topic())
 	slog.Info("processing node update for network", "network", network)
 	node := config.GetNode(network)
 	server := config.Servers[node.Server]
-	data, err := decryptMsg(server.Name, msg.Payload())
+	data, err := unwrapEnvelope(server.Name, msg.Topic(), msg.Payload())
 	if err != nil {
-		slog.Error("error decrypting message", "error", err)
+		slog.Error("error unwrapping node update message", "error", err)
+		metrics.DecryptFailures.Inc()
 		return
 	}
+	clearRetainedIfPolicy(client, msg.Topic())
 	serverNode := models.Node{}
 	if err = json.Unmarshal([]byte(data), &serverNode); err != nil {
 		slog.Error("error unmarshalling node update data", "error", err)
@@ -51,8 +62,10 @@ func NodeUpdate(client mqtt.Client, msg mqtt.Message) {
 	var currentMessage = read(newNode.Network, lastNodeUpdate)
 	if currentMessage == string(data) {
 		slog.Info("cache hit on node update ... skipping")
+		metrics.NodeUpdateCacheHits.WithLabelValues("hit").Inc()
 		return
 	}
+	metrics.NodeUpdateCacheHits.WithLabelValues("miss").Inc()
 	insert(newNode.Network, lastNodeUpdate, string(data)) // store new message in cache
 	slog.Info("received node update", "node", newNode.ID, "network", newNode.Network)
 	// check if interface needs to delta
@@ -99,6 +112,7 @@ func NodeUpdate(client mqtt.Client, msg mqtt.Message) {
 
 // HostPeerUpdate - mq handler for host peer update peers/host/<HOSTID>/<SERVERNAME>
 func HostPeerUpdate(client mqtt.Client, msg mqtt.Message) {
+	defer metrics.ObserveHandlerLatency("HostPeerUpdate", time.Now())
 	var peerUpdate models.HostPeerUpdate
 	var err error
 	if len(config.GetNodes()) == 0 {
@@ -112,9 +126,14 @@ func HostPeerUpdate(client mqtt.Client, msg mqtt.Message) {
 		return
 	}
 	slog.Info("processing peer update for server", "server", serverName)
-	data, err := decryptMsg(serverName, msg.Payload())
+	data, err := unwrapEnvelope(serverName, msg.Topic(), msg.Payload())
 	if err != nil {
-		slog.Error("error decrypting message", "error", err)
+		slog.Error("error unwrapping peer update message", "error", err)
+		metrics.DecryptFailures.Inc()
+		return
+	}
+	if shouldDedup(msg.Topic(), data) {
+		slog.Info("skipping duplicate peer update delivery", "server", serverName)
 		return
 	}
 	err = json.Unmarshal([]byte(data), &peerUpdate)
@@ -160,6 +179,7 @@ func HostPeerUpdate(client mqtt.Client, msg mqtt.Message) {
 
 // HostUpdate - mq handler for host update host/update/<HOSTID>/<SERVERNAME>
 func HostUpdate(client mqtt.Client, msg mqtt.Message) {
+	defer metrics.ObserveHandlerLatency("HostUpdate", time.Now())
 	var hostUpdate models.HostUpdate
 	var err error
 	serverName := parseServerFromTopic(msg.Topic())
@@ -171,21 +191,29 @@ func HostUpdate(client mqtt.Client, msg mqtt.Message) {
 	if len(msg.Payload()) == 0 {
 		return
 	}
-	data, err := decryptMsg(serverName, msg.Payload())
+	data, err := unwrapEnvelope(serverName, msg.Topic(), msg.Payload())
 	if err != nil {
-		slog.Error("error decrypting message", "error", err)
+		slog.Error("error unwrapping host update message", "error", err)
+		metrics.DecryptFailures.Inc()
+		clearRetainedIfPolicy(client, msg.Topic())
 		return
 	}
 	err = json.Unmarshal([]byte(data), &hostUpdate)
 	if err != nil {
 		slog.Error("error unmarshalling host update data", "error", err)
+		clearRetainedIfPolicy(client, msg.Topic())
+		return
+	}
+	// clear once up front, before dispatch, so no case below can forget it
+	clearRetainedIfPolicy(client, msg.Topic())
+	if shouldDedup(msg.Topic(), data) {
+		slog.Info("skipping duplicate host update delivery", "server", serverName, "action", hostUpdate.Action)
 		return
 	}
 	slog.Info("processing host update", "server", serverName, "action", hostUpdate.Action)
-	var resetInterface, restartDaemon, sendHostUpdate, clearMsg bool
+	var resetInterface, restartDaemon, sendHostUpdate bool
 	switch hostUpdate.Action {
 	case models.Upgrade:
-		clearRetainedMsg(client, msg.Topic())
 		cv, sv := config.Version, server.Version
 		slog.Info("checking if need to upgrade client to server's version", "", config.Version, "version", server.Version)
 		vlt, err := versionLessThan(cv, sv)
@@ -225,14 +253,12 @@ func HostUpdate(client mqtt.Client, msg mqtt.Message) {
 		config.WriteNodeConfig()
 		config.WriteServerConfig()
 		slog.Info("added node to network", "network", hostUpdate.Node.Network, "server", serverName)
-		clearRetainedMsg(client, msg.Topic()) // clear message before ACK
 		if err = PublishHostUpdate(serverName, models.Acknowledgement); err != nil {
 			slog.Error("failed to response with ACK to server", "server", serverName, "error", err)
 		}
 		setSubscriptions(client, &nodeCfg)
 		resetInterface = true
 	case models.DeleteHost:
-		clearRetainedMsg(client, msg.Topic())
 		unsubscribeHost(client, serverName)
 		deleteHostCfg(client, serverName)
 		config.WriteNodeConfig()
@@ -245,20 +271,15 @@ func HostUpdate(client mqtt.Client, msg mqtt.Message) {
 				slog.Error("could not publish host update", err.Error())
 			}
 		}
-		clearMsg = true
 	case models.RequestAck:
-		clearRetainedMsg(client, msg.Topic()) // clear message before ACK
 		if err = PublishHostUpdate(serverName, models.Acknowledgement); err != nil {
 			slog.Error("failed to response with ACK to server", "server", serverName, "error", err)
 		}
 	case models.SignalHost:
-		clearRetainedMsg(client, msg.Topic())
 		processPeerSignal(hostUpdate.Signal)
 	case models.UpdateKeys:
-		clearRetainedMsg(client, msg.Topic()) // clear message
 		UpdateKeys()
 	case models.RequestPull:
-		clearRetainedMsg(client, msg.Topic())
 		Pull(true)
 	default:
 		slog.Error("unknown host action", "action", hostUpdate.Action)
@@ -269,9 +290,6 @@ func HostUpdate(client mqtt.Client, msg mqtt.Message) {
 		return
 	}
 	if restartDaemon {
-		if clearMsg {
-			clearRetainedMsg(client, msg.Topic())
-		}
 		if err := daemon.Restart(); err != nil {
 			slog.Error("failed to restart daemon", "error", err)
 		}
@@ -292,48 +310,134 @@ func HostUpdate(client mqtt.Client, msg mqtt.Message) {
 	}
 }
 
-// handleEndpointDetection - select best interface for each peer and set it as endpoint
+// handleEndpointDetection - gather this host's ICE candidates for each peer, publish them, and
+// let the peer's own PeerCandidates response drive connectivity checks. Unlike the old LAN-only
+// probing, this also offers the server-reflexive candidate gathered below. No relayed candidate
+// is ever obtained (turnAllocate sends no Allocate request), so no TURN path is offered.
 func handleEndpointDetection(peers []wgtypes.PeerConfig, peerInfo models.HostInfoMap) {
-	currentCidrs := getAllAllowedIPs(peers[:])
 	for idx := range peers {
 		peerPubKey := peers[idx].PublicKey.String()
 		if wireguard.EndpointDetectedAlready(peerPubKey) {
 			continue
 		}
-		if peerInfo, ok := peerInfo[peerPubKey]; ok {
-			if peerInfo.IsStatic {
-				// peer is a static host shouldn't disturb the configuration set by the user
-				continue
-			}
-			for i := range peerInfo.Interfaces {
-				peerIface := peerInfo.Interfaces[i]
-				peerIP := peerIface.Address.IP
-				if peerIP == nil {
-					continue
-				}
-				// check to skip bridge network
-				if ncutils.IsBridgeNetwork(peerIface.Name) {
-					continue
-				}
-				if strings.Contains(peerIP.String(), "127.0.0.") ||
-					peerIP.IsMulticast() ||
-					(peerIP.IsLinkLocalUnicast() && strings.Count(peerIP.String(), ":") >= 2) ||
-					isAddressInPeers(peerIP, currentCidrs) {
-					continue
-				}
-				if peerIP.IsPrivate() {
-					go func(peerIP, peerPubKey string, listenPort int) {
-						networking.FindBestEndpoint(
-							peerIP,
-							peerPubKey,
-							peerInfo.ListenPort,
-						)
-					}(peerIP.String(), peerPubKey, peerInfo.ListenPort)
+		info, ok := peerInfo[peerPubKey]
+		if !ok {
+			continue
+		}
+		if info.IsStatic {
+			// peer is a static host shouldn't disturb the configuration set by the user
+			continue
+		}
+		go gatherAndPublishCandidates(peerPubKey)
+	}
+}
 
-				}
-			}
+// gatherAndPublishCandidates - collects this host's own local and server-reflexive candidates
+// and publishes them to peerPubKey so it can run connectivity checks against them; the peer does
+// the same for us over its own candidates message. A relayed candidate is requested when a TURN
+// server is configured, but that request always fails and only logs a warning.
+func gatherAndPublishCandidates(peerPubKey string) {
+	host := config.Netclient().Host
+	candidates := networking.GatherLocalCandidates(host.Interfaces, host.ListenPort)
+	if reflexive, err := networking.GatherServerReflexiveCandidate(stunServersFor(config.CurrServer), host.ListenPort); err == nil {
+		candidates = append(candidates, *reflexive)
+	} else {
+		slog.Warn("failed to gather server-reflexive candidate", "peer", peerPubKey, "error", err)
+	}
+	if turnServer, username, password, ok := turnCredentialsFor(config.CurrServer); ok {
+		if relayed, err := networking.GatherRelayedCandidate(turnServer, username, password, host.ListenPort); err == nil {
+			candidates = append(candidates, *relayed)
+		} else {
+			slog.Warn("failed to gather relayed candidate", "peer", peerPubKey, "error", err)
 		}
 	}
+	if len(candidates) == 0 {
+		slog.Warn("no ice candidates gathered for peer", "peer", peerPubKey)
+		return
+	}
+	payload := networking.PublishCandidates(host.ID.String(), peerPubKey, candidates)
+	if err := publishPeerCandidates(peerPubKey, &payload); err != nil {
+		slog.Warn("failed to publish peer candidates", "peer", peerPubKey, "error", err)
+	}
+}
+
+// stunServersFor - resolves the operator-configured STUN server list for serverName, falling
+// back to a public STUN server when none is configured.
+func stunServersFor(serverName string) []string {
+	server := config.GetServer(serverName)
+	if server == nil || len(server.StunServers) == 0 {
+		return []string{"stun.l.google.com:19302"}
+	}
+	return server.StunServers
+}
+
+// turnCredentialsFor - resolves the operator-configured TURN relay for serverName, if any. The
+// relay candidate is optional (unlike STUN, which always has a public fallback): with no TURN
+// server configured, gatherAndPublishCandidates simply skips the relay hop.
+func turnCredentialsFor(serverName string) (turnServer, username, password string, ok bool) {
+	server := config.GetServer(serverName)
+	if server == nil || server.TurnServer == "" {
+		return "", "", "", false
+	}
+	return server.TurnServer, server.TurnUsername, server.TurnPassword, true
+}
+
+// PeerCandidates - mq handler for signal/host/<PUBKEY>/<SERVERNAME>/candidates; runs ICE
+// connectivity checks against the sender's candidates and nominates the best reachable pair.
+//
+// Candidate exchange is host-to-host signaling relayed through the broker, not a server-issued
+// control message: the server never produces this payload, so it can't carry a server-signed
+// envelope the way NodeUpdate/HostPeerUpdate/HostUpdate do. It still rides the per-network
+// symmetric traffic key used for every other MQTT payload, just without the version/seq/nonce
+// replay-protected wrapper, since a stale or replayed candidate set only risks a failed
+// connectivity check, not a destructive action.
+func PeerCandidates(client mqtt.Client, msg mqtt.Message) {
+	serverName := parseServerFromTopic(msg.Topic())
+	data, err := decryptMsg(serverName, msg.Payload())
+	if err != nil {
+		slog.Error("error decrypting peer candidates message", "error", err)
+		metrics.DecryptFailures.Inc()
+		return
+	}
+	if shouldDedup(msg.Topic(), data) {
+		slog.Info("skipping duplicate peer candidates delivery")
+		return
+	}
+	var remote models.PeerCandidates
+	if err := json.Unmarshal([]byte(data), &remote); err != nil {
+		slog.Error("error unmarshalling peer candidates", "error", err)
+		return
+	}
+	host := config.Netclient().Host
+	local := networking.GatherLocalCandidates(host.Interfaces, host.ListenPort)
+	remoteCandidates := make([]networking.Candidate, 0, len(remote.Candidates))
+	for _, c := range remote.Candidates {
+		remoteCandidates = append(remoteCandidates, networking.Candidate{
+			Type:     networking.CandidateType(c.Type),
+			Addr:     net.UDPAddr{IP: net.ParseIP(c.IP), Port: c.Port},
+			Priority: c.Priority,
+		})
+	}
+	if err := networking.RunConnectivityChecks(remote.HostID, local, remoteCandidates, remote.Tiebreaker); err != nil {
+		slog.Warn("ice connectivity checks did not produce a usable pair", "peer", remote.HostID, "error", err)
+	}
+}
+
+// publishPeerCandidates - sends this host's gathered ICE candidates to peerPubKey over
+// signal/host/<peerPubKey>/<server>/candidates so the peer can run its own connectivity checks.
+// See the PeerCandidates doc comment for why this uses symmetric encryption without the
+// server-signed envelope.
+func publishPeerCandidates(peerPubKey string, payload *models.PeerCandidates) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := encryptMsg(config.CurrServer, data)
+	if err != nil {
+		return fmt.Errorf("error encrypting peer candidates: %w", err)
+	}
+	topic := fmt.Sprintf("signal/host/%s/%s/candidates", peerPubKey, config.CurrServer)
+	return publish(config.CurrServer, topic, ciphertext)
 }
 
 func deleteHostCfg(client mqtt.Client, server string) {
@@ -357,31 +461,6 @@ func parseServerFromTopic(topic string) string {
 	return strings.Split(topic, "/")[3]
 }
 
-func getAllAllowedIPs(peers []wgtypes.PeerConfig) (cidrs []net.IPNet) {
-	if len(peers) > 0 { // nil check
-		for i := range peers {
-			peer := peers[i]
-			cidrs = append(cidrs, peer.AllowedIPs...)
-		}
-	}
-	if cidrs == nil {
-		cidrs = []net.IPNet{}
-	}
-	return
-}
-
-func isAddressInPeers(ip net.IP, cidrs []net.IPNet) bool {
-	if len(cidrs) > 0 {
-		for i := range cidrs {
-			currCidr := cidrs[i]
-			if currCidr.Contains(ip) {
-				return true
-			}
-		}
-	}
-	return false
-}
-
 func handleFwUpdate(server string, payload *models.FwUpdate) {
 
 	if payload.IsEgressGw {
@@ -392,6 +471,11 @@ func handleFwUpdate(server string, payload *models.FwUpdate) {
 
 }
 
+// activeGRPCTransport - the gRPC control transport currently dispatching messages, when MQTT has
+// not recovered. Tracked so it can be Closed once MQTT reconnects, instead of being left dialed
+// and subscribed forever.
+var activeGRPCTransport *grpcTransport
+
 // MQTT Fallback Mechanism
 func mqFallback(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
@@ -403,26 +487,54 @@ func mqFallback(ctx context.Context, wg *sync.WaitGroup) {
 			slog.Info("mqfallback routine stop")
 			return
 		case <-mqFallbackTicker.C: // Execute pull every 30 seconds
-			if (Mqclient != nil && Mqclient.IsConnectionOpen() && Mqclient.IsConnected()) || config.CurrServer == "" {
+			if Mqclient != nil && Mqclient.IsConnectionOpen() && Mqclient.IsConnected() {
+				if activeGRPCTransport != nil {
+					slog.Info("mqtt transport recovered, closing fallback grpc transport")
+					activeGRPCTransport.Close()
+					activeGRPCTransport = nil
+				}
+				continue
+			}
+			if config.CurrServer == "" {
 				continue
 			}
 			// Call netclient http config pull
 			slog.Info("### mqfallback routine execute")
+			metrics.FallbackPulls.Inc()
 			response, resetInterface, replacePeers, err := Pull(false)
 			if err != nil {
 				slog.Error("pull failed", "error", err)
 			} else {
+				recordFallbackPull(time.Now())
 				mqFallbackPull(response, resetInterface, replacePeers)
 				server := config.GetServer(config.CurrServer)
 				if server == nil {
 					continue
 				}
-				slog.Info("re-attempt mqtt connection after pull")
-				if Mqclient != nil {
-					Mqclient.Disconnect(0)
+				slog.Info("re-attempt control transport connection after pull")
+				transport, err := raceTransports(ctx, server, Mqclient)
+				if err != nil {
+					slog.Error("unable to connect via mqtt or grpc transport", "server", server.Broker, "error", err)
+					continue
 				}
-				if err := setupMQTT(server); err != nil {
-					slog.Error("unable to connect to broker", "server", server.Broker, "error", err)
+				switch t := transport.(type) {
+				case *mqttTransport:
+					// onMQTTConnect already counted this connect (either just now, via
+					// setupMQTT inside raceTransports, or on an earlier successful connect this
+					// transport was reused from); counting it again here would double it.
+					slog.Info("mqtt transport won handshake race")
+					Mqclient = t.client
+				case *grpcTransport:
+					slog.Info("grpc transport won handshake race, dispatching control messages over grpc until mqtt recovers")
+					if err := subscribeControlHandlers(t); err != nil {
+						slog.Error("failed to subscribe control handlers over grpc transport", "error", err)
+						t.Close()
+						continue
+					}
+					if activeGRPCTransport != nil {
+						activeGRPCTransport.Close()
+					}
+					activeGRPCTransport = t
 				}
 			}
 
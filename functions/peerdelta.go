@@ -0,0 +1,88 @@
+package functions
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/wireguard"
+	"github.com/gravitl/netmaker/models"
+	"golang.org/x/exp/slog"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// maxGenerationBehind - once the client's stored generation lags the server's by more than this,
+// it falls back to a full Pull/ReplacePeers sync rather than trusting the delta chain.
+const maxGenerationBehind = 5
+
+// HostPeerDelta - mq handler for peers/host/delta/<HOSTID>/<SERVERNAME>; applies an incremental
+// peer change instead of the full HostPeerUpdate's ReplacePeers, avoiding handshake churn on
+// hosts with hundreds of peers when only a handful actually changed.
+func HostPeerDelta(client mqtt.Client, msg mqtt.Message) {
+	// the extra "delta" segment puts SERVERNAME at index 4, not parseServerFromTopic's index 3
+	serverName := strings.Split(msg.Topic(), "/")[4]
+	server := config.GetServer(serverName)
+	if server == nil {
+		slog.Error("server not found in config", "server", serverName)
+		return
+	}
+	data, err := unwrapEnvelope(serverName, msg.Topic(), msg.Payload())
+	if err != nil {
+		slog.Error("error unwrapping peer delta message", "error", err)
+		return
+	}
+	var delta models.HostPeerDelta
+	if err := json.Unmarshal(data, &delta); err != nil {
+		slog.Error("error unmarshalling peer delta", "error", err)
+		return
+	}
+
+	lastGen := config.Netclient().HostPeerGeneration
+	if delta.Generation <= lastGen {
+		slog.Info("skipping stale peer delta", "generation", delta.Generation, "last", lastGen)
+		return
+	}
+	if delta.Generation-lastGen > maxGenerationBehind {
+		slog.Warn("peer delta generation too far ahead, falling back to full sync", "generation", delta.Generation, "last", lastGen)
+		Pull(true)
+		return
+	}
+
+	if err := applyPeerDelta(&delta); err != nil {
+		slog.Error("error applying peer delta, falling back to full sync", "error", err)
+		Pull(true)
+		return
+	}
+
+	config.Netclient().HostPeerGeneration = delta.Generation
+	if err := config.WriteNetclientConfig(); err != nil {
+		slog.Warn("failed to persist peer delta generation", "error", err)
+	}
+}
+
+// applyPeerDelta - configures only the added/removed/modified peers via wgctrl, with
+// ReplacePeers=false so unrelated peers are left untouched.
+func applyPeerDelta(delta *models.HostPeerDelta) error {
+	var peerConfigs []wgtypes.PeerConfig
+	for _, p := range delta.Removed {
+		p.Remove = true
+		peerConfigs = append(peerConfigs, p)
+	}
+	for _, p := range delta.Added {
+		peerConfigs = append(peerConfigs, p)
+	}
+	for _, p := range delta.Modified {
+		p.UpdateOnly = true
+		peerConfigs = append(peerConfigs, p)
+	}
+	if len(peerConfigs) == 0 {
+		return nil
+	}
+	if err := wireguard.ApplyPeerDelta(peerConfigs); err != nil {
+		return fmt.Errorf("error configuring device with peer delta: %w", err)
+	}
+	config.UpdateHostPeersDelta(delta.Added, delta.Removed, delta.Modified)
+	return nil
+}
@@ -0,0 +1,110 @@
+package functions
+
+import (
+	"crypto/sha256"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gravitl/netclient/config"
+)
+
+// TopicPolicy - per-topic MQTT QoS and retained-message behavior. Operators can override the
+// defaults via config.Netclient().TopicPolicies, keyed by the same topic pattern used below.
+type TopicPolicy struct {
+	QoS      byte          `json:"qos" yaml:"qos"`
+	Retained bool          `json:"retained" yaml:"retained"`
+	DedupTTL time.Duration `json:"dedup_ttl" yaml:"dedup_ttl"`
+}
+
+// defaultTopicPolicies - keyed by topic pattern; state-changing node/host actions (NODE_DELETE,
+// DeleteHost, Upgrade) ride on QoS 2 so delivery can't be silently dropped, while the higher
+// volume peer/signal topics stay at the previous best-effort QoS 0/1.
+var defaultTopicPolicies = map[string]TopicPolicy{
+	"update/#":      {QoS: 2, Retained: true, DedupTTL: time.Minute},
+	"peers/host/#":  {QoS: 1, Retained: true, DedupTTL: time.Minute},
+	"host/update/#": {QoS: 2, Retained: true, DedupTTL: time.Minute},
+	"signal/#":      {QoS: 0, Retained: false},
+}
+
+// GetTopicPolicy - resolves the policy for topic, preferring an operator override in
+// config.Netclient().TopicPolicies over the repo default, and falling back to QoS 1 retained
+// if no pattern matches.
+func GetTopicPolicy(topic string) TopicPolicy {
+	if overrides := config.Netclient().TopicPolicies; overrides != nil {
+		for pattern, policy := range overrides {
+			if topicMatchesPattern(topic, pattern) {
+				return policy
+			}
+		}
+	}
+	for pattern, policy := range defaultTopicPolicies {
+		if topicMatchesPattern(topic, pattern) {
+			return policy
+		}
+	}
+	return TopicPolicy{QoS: 1, Retained: true}
+}
+
+// topicMatchesPattern - supports the single trailing "#" wildcard used throughout netclient's
+// topic patterns (e.g. "update/#" matches "update/<network>").
+func topicMatchesPattern(topic, pattern string) bool {
+	if strings.HasSuffix(pattern, "/#") {
+		return strings.HasPrefix(topic, strings.TrimSuffix(pattern, "#"))
+	}
+	return topic == pattern
+}
+
+// clearRetainedIfPolicy - centralizes retained-message cleanup so no dispatch branch has to
+// repeat it. NodeUpdate calls it once, right after its envelope unwraps; HostUpdate calls it once
+// on every path past its empty-payload check, its unwrap and unmarshal error paths included.
+// HostPeerUpdate, HostPeerDelta and PeerCandidates do not call it. client is nil
+// when a handler is dispatched over the gRPC fallback transport (grpcTransport.recvLoop), which
+// has no retained MQTT message to clear, so that case is a no-op rather than a nil dereference.
+func clearRetainedIfPolicy(client mqtt.Client, topic string) {
+	if client == nil || !GetTopicPolicy(topic).Retained {
+		return
+	}
+	clearRetainedMsg(client, topic)
+}
+
+// dedupSeenMu / dedupSeen - tracks the last-seen time of a topic+payload digest so a message
+// redelivered within its TopicPolicy.DedupTTL (e.g. a QoS 1/2 broker re-sending an unacked
+// retained message) is processed only once.
+var (
+	dedupSeenMu sync.Mutex
+	dedupSeen   = map[string]time.Time{}
+)
+
+// shouldDedup - reports whether topic+payload was already seen within its policy's DedupTTL, and
+// records it as seen either way. A zero DedupTTL disables dedup for that topic.
+func shouldDedup(topic string, payload []byte) bool {
+	ttl := GetTopicPolicy(topic).DedupTTL
+	if ttl <= 0 {
+		return false
+	}
+	sum := sha256.Sum256(payload)
+	key := topic + ":" + string(sum[:])
+	now := time.Now()
+
+	dedupSeenMu.Lock()
+	defer dedupSeenMu.Unlock()
+	purgeExpiredDedupEntriesLocked(now)
+	if seenAt, ok := dedupSeen[key]; ok && now.Sub(seenAt) < ttl {
+		return true
+	}
+	dedupSeen[key] = now
+	return false
+}
+
+// purgeExpiredDedupEntriesLocked - drops entries older than maxAge, comfortably past every
+// policy's DedupTTL above, so dedupSeen doesn't grow unbounded. Caller must hold dedupSeenMu.
+func purgeExpiredDedupEntriesLocked(now time.Time) {
+	const maxAge = 5 * time.Minute
+	for key, seenAt := range dedupSeen {
+		if now.Sub(seenAt) > maxAge {
+			delete(dedupSeen, key)
+		}
+	}
+}
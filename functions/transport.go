@@ -0,0 +1,236 @@
+package functions
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gravitl/netclient/config"
+	controlpb "github.com/gravitl/netclient/functions/controlpb"
+	"golang.org/x/exp/slog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// ControlTransport - abstracts the channel used to exchange control messages (node/peer/host
+// updates) with the server, so MQTT and gRPC implementations can be raced against each other
+// without the handler dispatch layer (NodeUpdate/HostPeerUpdate/HostUpdate) knowing which is live.
+type ControlTransport interface {
+	// Subscribe registers handler to be called for every message received on topic
+	Subscribe(topic string, handler mqtt.MessageHandler) error
+	// Publish sends payload to topic
+	Publish(topic string, retained bool, payload []byte) error
+	// Ack acknowledges successful processing of a message, clearing it server-side if retained
+	Ack(topic string) error
+	// Close tears down the underlying connection
+	Close()
+}
+
+// mqttTransport - ControlTransport backed by the existing paho MQTT client
+type mqttTransport struct {
+	client mqtt.Client
+}
+
+func newMQTTTransport(client mqtt.Client) *mqttTransport {
+	return &mqttTransport{client: client}
+}
+
+func (t *mqttTransport) Subscribe(topic string, handler mqtt.MessageHandler) error {
+	policy := GetTopicPolicy(topic)
+	if tok := t.client.Subscribe(topic, policy.QoS, handler); tok.Wait() && tok.Error() != nil {
+		return tok.Error()
+	}
+	return nil
+}
+
+func (t *mqttTransport) Publish(topic string, retained bool, payload []byte) error {
+	policy := GetTopicPolicy(topic)
+	if tok := t.client.Publish(topic, policy.QoS, retained, payload); tok.Wait() && tok.Error() != nil {
+		return tok.Error()
+	}
+	return nil
+}
+
+func (t *mqttTransport) Ack(topic string) error {
+	clearRetainedMsg(t.client, topic)
+	return nil
+}
+
+func (t *mqttTransport) Close() {
+	if t.client != nil {
+		t.client.Disconnect(250)
+	}
+}
+
+// grpcTransport - ControlTransport backed by a bidirectional gRPC stream to the server, used
+// as a fallback when the MQTT broker is unreachable (e.g. behind a firewall permitting only
+// outbound HTTPS). Handshake success is a completed blocking dial plus an opened Stream; no
+// message is received before the transport is returned.
+type grpcTransport struct {
+	conn    *grpc.ClientConn
+	stream  controlpb.Control_StreamClient
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	handler map[string]mqtt.MessageHandler
+}
+
+func newGRPCTransport(ctx context.Context, server *config.Server) (*grpcTransport, error) {
+	creds := credentials.NewTLS(nil)
+	conn, err := grpc.DialContext(ctx, server.API, grpc.WithTransportCredentials(creds), grpc.WithBlock())
+	if err != nil {
+		return nil, fmt.Errorf("error dialing control grpc endpoint: %w", err)
+	}
+	streamCtx, cancel := context.WithCancel(ctx)
+	stream, err := controlpb.NewControlClient(conn).Stream(streamCtx)
+	if err != nil {
+		cancel()
+		conn.Close()
+		return nil, fmt.Errorf("error opening control stream: %w", err)
+	}
+	t := &grpcTransport{conn: conn, stream: stream, cancel: cancel, handler: map[string]mqtt.MessageHandler{}}
+	go t.recvLoop()
+	return t, nil
+}
+
+func (t *grpcTransport) recvLoop() {
+	for {
+		msg, err := t.stream.Recv()
+		if err != nil {
+			slog.Warn("control grpc stream closed", "error", err)
+			return
+		}
+		// handlers are registered under topic patterns (e.g. "update/#"), so match the concrete
+		// topic against each pattern, calling every match as the MQTT client would
+		t.mu.Lock()
+		var handlers []mqtt.MessageHandler
+		for pattern, handler := range t.handler {
+			if topicMatchesPattern(msg.Topic, pattern) {
+				handlers = append(handlers, handler)
+			}
+		}
+		t.mu.Unlock()
+		for _, handler := range handlers {
+			handler(nil, &grpcMessage{topic: msg.Topic, payload: msg.Payload})
+		}
+	}
+}
+
+func (t *grpcTransport) Subscribe(topic string, handler mqtt.MessageHandler) error {
+	t.mu.Lock()
+	t.handler[topic] = handler
+	t.mu.Unlock()
+	return t.stream.Send(&controlpb.ControlMessage{Topic: topic, Type: controlpb.ControlMessage_SUBSCRIBE})
+}
+
+func (t *grpcTransport) Publish(topic string, retained bool, payload []byte) error {
+	return t.stream.Send(&controlpb.ControlMessage{Topic: topic, Payload: payload, Retained: retained})
+}
+
+func (t *grpcTransport) Ack(topic string) error {
+	return t.stream.Send(&controlpb.ControlMessage{Topic: topic, Type: controlpb.ControlMessage_ACK})
+}
+
+func (t *grpcTransport) Close() {
+	t.cancel()
+	if t.conn != nil {
+		t.conn.Close()
+	}
+}
+
+// grpcMessage - adapts a controlpb message to the mqtt.Message interface expected by existing handlers
+type grpcMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *grpcMessage) Duplicate() bool     { return false }
+func (m *grpcMessage) Qos() byte           { return 0 }
+func (m *grpcMessage) Retained() bool      { return false }
+func (m *grpcMessage) Topic() string       { return m.topic }
+func (m *grpcMessage) MessageID() uint16   { return 0 }
+func (m *grpcMessage) Payload() []byte     { return m.payload }
+func (m *grpcMessage) Ack()                {}
+
+// transportRaceResult - one side's outcome in raceTransports
+type transportRaceResult struct {
+	transport ControlTransport
+	err       error
+}
+
+// raceTransports - dials both an MQTT and a gRPC transport concurrently and returns whichever
+// completes its handshake first. Exactly two results are ever sent on results, so whichever one
+// is not returned to the caller is picked up by closeRemainingTransport and Closed once it
+// arrives, instead of being leaked.
+func raceTransports(ctx context.Context, server *config.Server, mqttClient mqtt.Client) (ControlTransport, error) {
+	results := make(chan transportRaceResult, 2)
+
+	go func() {
+		if mqttClient != nil && mqttClient.IsConnectionOpen() && mqttClient.IsConnected() {
+			results <- transportRaceResult{transport: newMQTTTransport(mqttClient)}
+			return
+		}
+		// mqttClient is down (that's why raceTransports was called); actually attempt to
+		// re-establish the broker connection instead of just reporting it absent, or MQTT can
+		// never win this race again and every future fallback cycle falls through to gRPC.
+		if err := setupMQTT(server); err != nil {
+			results <- transportRaceResult{err: fmt.Errorf("mqtt transport not connected: %w", err)}
+			return
+		}
+		results <- transportRaceResult{transport: newMQTTTransport(Mqclient)}
+	}()
+	go func() {
+		gctx, cancel := context.WithTimeout(ctx, MQTimeout*time.Second)
+		defer cancel()
+		t, err := newGRPCTransport(gctx, server)
+		results <- transportRaceResult{transport: t, err: err}
+	}()
+
+	first := <-results
+	if first.err == nil {
+		go closeRemainingTransport(results)
+		return first.transport, nil
+	}
+	second := <-results
+	if second.err == nil {
+		return second.transport, nil
+	}
+	return nil, fmt.Errorf("mqtt transport: %v, grpc transport: %w", first.err, second.err)
+}
+
+// controlTopicHandlers - the topic patterns and handlers setupMQTT subscribes the MQTT client to;
+// used to drive the same subscriptions over a gRPC transport that won the race in raceTransports,
+// since the handler dispatch layer (NodeUpdate/HostPeerUpdate/HostUpdate/...) is transport-agnostic.
+var controlTopicHandlers = []struct {
+	topic   string
+	handler mqtt.MessageHandler
+}{
+	{"update/#", NodeUpdate},
+	{"peers/host/#", HostPeerUpdate},
+	{"peers/host/delta/#", HostPeerDelta},
+	{"host/update/#", HostUpdate},
+	{"signal/#", PeerCandidates},
+}
+
+// subscribeControlHandlers - registers every known control handler on transport, so a gRPC
+// transport that wins the handshake race actually receives and dispatches messages instead of
+// being dialed and then left idle.
+func subscribeControlHandlers(transport ControlTransport) error {
+	for _, s := range controlTopicHandlers {
+		if err := transport.Subscribe(s.topic, s.handler); err != nil {
+			return fmt.Errorf("error subscribing to %s over control transport: %w", s.topic, err)
+		}
+	}
+	return nil
+}
+
+// closeRemainingTransport - consumes the one result raceTransports didn't return to its caller
+// and closes its transport, if any, so a losing gRPC dial/stream doesn't leak a connection and
+// a goroutine.
+func closeRemainingTransport(results chan transportRaceResult) {
+	loser := <-results
+	if loser.transport != nil {
+		loser.transport.Close()
+	}
+}
@@ -0,0 +1,122 @@
+// Package metrics exposes an in-process Prometheus registry plus a JSON /status endpoint so
+// operators get the same observability netbird-style clients offer, instead of only slog
+// breadcrumbs that can't be alerted on.
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/exp/slog"
+)
+
+var (
+	// MQTTConnects - count of successful MQTT broker connections
+	MQTTConnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netclient_mqtt_connects_total",
+		Help: "Total number of successful MQTT broker connections.",
+	})
+	// MQTTDisconnects - count of MQTT disconnect events
+	MQTTDisconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netclient_mqtt_disconnects_total",
+		Help: "Total number of MQTT disconnect events.",
+	})
+	// HandlerLatency - processing latency per mq handler
+	HandlerLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "netclient_handler_duration_seconds",
+		Help: "Processing latency of node/peer/host update handlers.",
+	}, []string{"handler"})
+	// DecryptFailures - count of message decrypt/verify failures
+	DecryptFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netclient_decrypt_failures_total",
+		Help: "Total number of MQTT message decrypt or signature verification failures.",
+	})
+	// NodeUpdateCacheHits - cache hit/miss on lastNodeUpdate
+	NodeUpdateCacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "netclient_node_update_cache_total",
+		Help: "Cache hit/miss count when deduping node updates against lastNodeUpdate.",
+	}, []string{"result"})
+	// FallbackPulls - count of HTTP pull fallbacks triggered by mqFallback
+	FallbackPulls = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netclient_fallback_pulls_total",
+		Help: "Total number of HTTP config pulls triggered by the MQTT fallback routine.",
+	})
+	// PeerHandshakeAge - seconds since each peer's last WireGuard handshake
+	PeerHandshakeAge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "netclient_peer_handshake_age_seconds",
+		Help: "Seconds since the last WireGuard handshake with each peer.",
+	}, []string{"peer"})
+	// PeerBytes - cumulative RX/TX bytes per peer, pulled from wgctrl
+	PeerBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "netclient_peer_bytes_total",
+		Help: "Cumulative bytes transferred per peer, as reported by wgctrl.",
+	}, []string{"peer", "direction"})
+)
+
+// ObserveHandlerLatency - records the elapsed time since start against HandlerLatency for the
+// named handler. Intended to be called via defer at the top of each mq handler.
+func ObserveHandlerLatency(handler string, start time.Time) {
+	HandlerLatency.WithLabelValues(handler).Observe(time.Since(start).Seconds())
+}
+
+// Status - JSON-serializable snapshot mirroring the metrics above, for `netclient status` and
+// the /status HTTP endpoint.
+type Status struct {
+	MQTTConnected    bool         `json:"mqtt_connected"`
+	LastFallbackPull time.Time    `json:"last_fallback_pull,omitempty"`
+	Peers            []PeerStatus `json:"peers"`
+}
+
+// PeerStatus - per-peer snapshot included in Status
+type PeerStatus struct {
+	PublicKey     string    `json:"public_key"`
+	LastHandshake time.Time `json:"last_handshake"`
+	RxBytes       int64     `json:"rx_bytes"`
+	TxBytes       int64     `json:"tx_bytes"`
+}
+
+// StatusFunc - supplied by the caller to build a fresh Status snapshot on each /status request
+type StatusFunc func() Status
+
+// Server - hosts the /metrics and /status endpoints on loopback
+type Server struct {
+	httpServer *http.Server
+}
+
+// StartServer - binds an HTTP server on loopback:port (port 0 lets the OS pick a free port;
+// functions.StartMetricsServer treats 0 as disabled and never passes it) serving Prometheus
+// metrics at /metrics and a JSON snapshot at /status built from statusFn on each request.
+func StartServer(port int, statusFn StatusFunc) (*Server, error) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(statusFn()); err != nil {
+			slog.Error("error encoding status response", "error", err)
+		}
+	})
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error binding metrics listener on %s: %w", addr, err)
+	}
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Error("metrics server stopped", "error", err)
+		}
+	}()
+	return &Server{httpServer: srv}, nil
+}
+
+// Stop - gracefully shuts down the metrics/status HTTP server
+func (s *Server) Stop(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
@@ -0,0 +1,279 @@
+package networking
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gravitl/netclient/wireguard"
+	"github.com/gravitl/netmaker/models"
+	"golang.org/x/exp/slog"
+)
+
+// CandidateType - the ICE candidate type, used to weight priority calculation
+type CandidateType int
+
+const (
+	// CandidateHost - a local interface address
+	CandidateHost CandidateType = iota
+	// CandidateServerReflexive - the address/port observed by a STUN server
+	CandidateServerReflexive
+	// CandidateRelay - an address allocated on a TURN relay
+	CandidateRelay
+)
+
+// typePreference - per RFC 8445 ยง5.1.2.1, host > srflx > relay
+func (t CandidateType) typePreference() uint32 {
+	switch t {
+	case CandidateHost:
+		return 126
+	case CandidateServerReflexive:
+		return 100
+	case CandidateRelay:
+		return 0
+	default:
+		return 0
+	}
+}
+
+// Candidate - a single ICE-lite candidate for a peer's WireGuard endpoint
+type Candidate struct {
+	Type      CandidateType `json:"type"`
+	Addr      net.UDPAddr   `json:"addr"`
+	Priority  uint32        `json:"priority"`
+	Component uint8         `json:"component"`
+}
+
+// localPreference - fixed at the max for every candidate, so candidates of the same type
+// (e.g. the host candidates of several interfaces) all get the same priority.
+const localPreference = 65535
+
+// computePriority - standard ICE priority formula: (2^24)*type_pref + (2^8)*local_pref + (256 - component)
+func computePriority(candType CandidateType, component uint8) uint32 {
+	return (1<<24)*candType.typePreference() + (1<<8)*localPreference + uint32(256-int(component))
+}
+
+// GatherLocalCandidates - builds host candidates from this host's interface addresses
+func GatherLocalCandidates(interfaces []models.Iface, port int) []Candidate {
+	var candidates []Candidate
+	for _, iface := range interfaces {
+		if iface.Address.IP == nil || iface.Address.IP.IsLoopback() {
+			continue
+		}
+		c := Candidate{
+			Type:      CandidateHost,
+			Addr:      net.UDPAddr{IP: iface.Address.IP, Port: port},
+			Component: 1,
+		}
+		c.Priority = computePriority(c.Type, c.Component)
+		candidates = append(candidates, c)
+	}
+	return candidates
+}
+
+// GatherServerReflexiveCandidate - sends a STUN Binding request to the first reachable
+// server in stunServers and returns the mapped address it reports.
+func GatherServerReflexiveCandidate(stunServers []string, localPort int) (*Candidate, error) {
+	for _, addr := range stunServers {
+		mapped, err := stunBindingRequest(addr, localPort)
+		if err != nil {
+			slog.Warn("stun binding request failed", "server", addr, "error", err)
+			continue
+		}
+		return &Candidate{
+			Type:      CandidateServerReflexive,
+			Addr:      *mapped,
+			Component: 1,
+			Priority:  computePriority(CandidateServerReflexive, 1),
+		}, nil
+	}
+	return nil, fmt.Errorf("no reachable stun server in %v", stunServers)
+}
+
+// GatherRelayedCandidate - wraps the relayed address from turnAllocate as a relay candidate.
+// turnAllocate sends no Allocate request and always fails, so this always returns an error.
+func GatherRelayedCandidate(turnServer, username, password string, localPort int) (*Candidate, error) {
+	relayed, err := turnAllocate(turnServer, username, password, localPort)
+	if err != nil {
+		return nil, fmt.Errorf("turn allocate failed: %w", err)
+	}
+	return &Candidate{
+		Type:      CandidateRelay,
+		Addr:      *relayed,
+		Component: 1,
+		Priority:  computePriority(CandidateRelay, 1),
+	}, nil
+}
+
+// CandidatePair - a local/remote candidate pair under connectivity checking
+type CandidatePair struct {
+	Local    Candidate
+	Remote   Candidate
+	Priority uint64
+	Valid    bool
+}
+
+// pairPriority - RFC 8445 ยง6.1.2.3 pairing formula, symmetric on controlling/controlled role
+func pairPriority(controllingPrio, controlledPrio uint32) uint64 {
+	g, d := uint64(controllingPrio), uint64(controlledPrio)
+	min, max := g, d
+	if d < g {
+		min, max = d, g
+	}
+	result := (min << 32) + (max << 1)
+	if g > d {
+		result++
+	}
+	return result
+}
+
+// agentState - per-peer ICE-lite connectivity check state
+type agentState struct {
+	mu            sync.Mutex
+	peerPubKey    string
+	tiebreaker    uint64
+	controlling   bool
+	nominated     *CandidatePair
+	stopKeepalive chan struct{}
+}
+
+var (
+	agentsMu sync.Mutex
+	agents   = map[string]*agentState{}
+)
+
+func newTiebreaker() uint64 {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// getOrCreateAgent - returns the ICE agent tracking state for a peer, creating it on first use
+func getOrCreateAgent(peerPubKey string) *agentState {
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+	a, ok := agents[peerPubKey]
+	if !ok {
+		a = &agentState{peerPubKey: peerPubKey, tiebreaker: newTiebreaker()}
+		agents[peerPubKey] = a
+	}
+	return a
+}
+
+// RunConnectivityChecks - runs STUN Binding checks (with USE-CANDIDATE when this side is
+// controlling) one at a time across every local x remote candidate pair for peerPubKey, highest
+// priority first, and promotes the first pair that completes a check to the WireGuard endpoint. Role (controlling/controlled) is decided by
+// comparing each side's random tiebreaker, per ICE's conflict-resolution rule.
+func RunConnectivityChecks(peerPubKey string, local []Candidate, remote []Candidate, remoteTiebreaker uint64) error {
+	agent := getOrCreateAgent(peerPubKey)
+	agent.mu.Lock()
+	agent.controlling = agent.tiebreaker > remoteTiebreaker
+	agent.mu.Unlock()
+
+	pairs := buildPairs(local, remote)
+	for i := range pairs {
+		pair := &pairs[i]
+		ok, err := stunConnectivityCheck(pair, agent.controlling)
+		if err != nil {
+			slog.Warn("connectivity check failed", "peer", peerPubKey, "local", pair.Local.Addr, "remote", pair.Remote.Addr, "error", err)
+			continue
+		}
+		if ok {
+			pair.Valid = true
+			return nominate(peerPubKey, agent, pair)
+		}
+	}
+	return fmt.Errorf("no candidate pair for peer %s completed a connectivity check", peerPubKey)
+}
+
+// buildPairs - forms every local x remote candidate combination, sorted highest priority first
+func buildPairs(local, remote []Candidate) []CandidatePair {
+	var pairs []CandidatePair
+	for _, l := range local {
+		for _, r := range remote {
+			pairs = append(pairs, CandidatePair{Local: l, Remote: r, Priority: pairPriority(l.Priority, r.Priority)})
+		}
+	}
+	for i := 0; i < len(pairs); i++ {
+		for j := i + 1; j < len(pairs); j++ {
+			if pairs[j].Priority > pairs[i].Priority {
+				pairs[i], pairs[j] = pairs[j], pairs[i]
+			}
+		}
+	}
+	return pairs
+}
+
+// nominate - promotes pair to the active WireGuard endpoint and starts a keepalive on it. If the
+// keepalive later fails, the peer's agent state is cleared (see keepalive); no other pair is
+// checked at that point.
+func nominate(peerPubKey string, agent *agentState, pair *CandidatePair) error {
+	if err := wireguard.SetPeerEndpoint(peerPubKey, &pair.Remote.Addr); err != nil {
+		return fmt.Errorf("error setting peer endpoint: %w", err)
+	}
+	agent.mu.Lock()
+	if agent.stopKeepalive != nil {
+		close(agent.stopKeepalive)
+	}
+	agent.nominated = pair
+	agent.stopKeepalive = make(chan struct{})
+	stop := agent.stopKeepalive
+	agent.mu.Unlock()
+
+	slog.Info("nominated ice candidate pair", "peer", peerPubKey, "endpoint", pair.Remote.Addr.String())
+	go keepalive(peerPubKey, pair, stop)
+	return nil
+}
+
+// keepalive - periodically re-checks the nominated pair, clearing it on failure so the next
+// peer update's candidate exchange can re-nominate a replacement.
+func keepalive(peerPubKey string, pair *CandidatePair, stop chan struct{}) {
+	ticker := time.NewTicker(25 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if ok, err := stunConnectivityCheck(pair, true); err != nil || !ok {
+				slog.Warn("ice keepalive failed, clearing nomination", "peer", peerPubKey, "error", err)
+				agentsMu.Lock()
+				delete(agents, peerPubKey)
+				agentsMu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// PublishCandidates - builds the PeerCandidates message payload for this host's locally
+// gathered candidates, to be published over MQTT on signal/host/<peerPubKey>/<serverName>/candidates.
+// peerPubKey identifies the peer this exchange is with, so the published message carries this
+// side's per-peer ICE tiebreaker for role resolution in RunConnectivityChecks.
+func PublishCandidates(hostID, peerPubKey string, candidates []Candidate) models.PeerCandidates {
+	agent := getOrCreateAgent(peerPubKey)
+	agent.mu.Lock()
+	tiebreaker := agent.tiebreaker
+	agent.mu.Unlock()
+	return models.PeerCandidates{
+		HostID:     hostID,
+		Candidates: toWireCandidates(candidates),
+		Tiebreaker: tiebreaker,
+	}
+}
+
+func toWireCandidates(candidates []Candidate) []models.ICECandidate {
+	wire := make([]models.ICECandidate, 0, len(candidates))
+	for _, c := range candidates {
+		wire = append(wire, models.ICECandidate{
+			Type:     int(c.Type),
+			IP:       c.Addr.IP.String(),
+			Port:     c.Addr.Port,
+			Priority: c.Priority,
+		})
+	}
+	return wire
+}
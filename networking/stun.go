@@ -0,0 +1,131 @@
+package networking
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Minimal RFC 5389 STUN client: just enough to send a Binding request and parse the
+// XOR-MAPPED-ADDRESS attribute back out of a Binding success response. No TLS, no long-term
+// credentials; good enough for NAT discovery against public STUN servers.
+
+const (
+	stunMagicCookie        uint32 = 0x2112A442
+	stunBindingRequestType uint16 = 0x0001
+	stunXorMappedAddr      uint16 = 0x0020
+	stunUseCandidate       uint16 = 0x0025
+)
+
+// stunBindingRequest - sends a STUN Binding request from localPort to addr and returns the
+// server-reflexive address the server observed the request coming from.
+func stunBindingRequest(addr string, localPort int) (*net.UDPAddr, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving stun server address: %w", err)
+	}
+	conn, err := net.DialUDP("udp", &net.UDPAddr{Port: localPort}, serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing stun server: %w", err)
+	}
+	defer conn.Close()
+
+	txID := make([]byte, 12)
+	req := buildStunHeader(stunBindingRequestType, txID, 0)
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(req); err != nil {
+		return nil, fmt.Errorf("error sending stun request: %w", err)
+	}
+
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading stun response: %w", err)
+	}
+	return parseXorMappedAddr(buf[:n], txID)
+}
+
+// stunConnectivityCheck - sends a Binding request to pair.Remote, setting USE-CANDIDATE when
+// useCandidate (i.e. this side is the controlling agent) nominating the pair on success.
+//
+// The check is sent from pair.Local's own port, not dialed "to" pair.Local.Addr: for a
+// server-reflexive candidate, Local.Addr is the public address a STUN server observed, which
+// isn't a locally bindable address, and for a host candidate it's the WireGuard listen port,
+// which is already in use. Binding the wildcard address at that port and writing to the remote
+// address directly works for both; it relies on the OS allowing the rebind (SO_REUSEADDR/PORT)
+// of a port WireGuard itself holds, same as other userspace ICE-lite implementations that
+// multiplex STUN checks over the data port.
+func stunConnectivityCheck(pair *CandidatePair, useCandidate bool) (bool, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: pair.Local.Addr.Port})
+	if err != nil {
+		return false, fmt.Errorf("error binding local candidate port %d: %w", pair.Local.Addr.Port, err)
+	}
+	defer conn.Close()
+
+	txID := make([]byte, 12)
+	attrLen := uint16(0)
+	if useCandidate {
+		attrLen = 4
+	}
+	req := buildStunHeader(stunBindingRequestType, txID, attrLen)
+	if useCandidate {
+		req = append(req, byte(stunUseCandidate>>8), byte(stunUseCandidate), 0, 0)
+	}
+	_ = conn.SetDeadline(time.Now().Add(1 * time.Second))
+	if _, err := conn.WriteToUDP(req, &pair.Remote.Addr); err != nil {
+		return false, fmt.Errorf("error sending connectivity check: %w", err)
+	}
+
+	buf := make([]byte, 512)
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		return false, nil // timeout/unreachable just means this pair doesn't work
+	}
+	if _, err := parseXorMappedAddr(buf[:n], txID); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+func buildStunHeader(msgType uint16, txID []byte, attrLen uint16) []byte {
+	header := make([]byte, 20)
+	binary.BigEndian.PutUint16(header[0:2], msgType)
+	binary.BigEndian.PutUint16(header[2:4], attrLen)
+	binary.BigEndian.PutUint32(header[4:8], stunMagicCookie)
+	copy(header[8:20], txID)
+	return header
+}
+
+// parseXorMappedAddr - walks a STUN message's TLV attributes looking for XOR-MAPPED-ADDRESS
+func parseXorMappedAddr(msg []byte, txID []byte) (*net.UDPAddr, error) {
+	if len(msg) < 20 {
+		return nil, fmt.Errorf("stun message too short")
+	}
+	attrs := msg[20:]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := binary.BigEndian.Uint16(attrs[2:4])
+		if int(attrLen)+4 > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+attrLen]
+		if attrType == stunXorMappedAddr && len(value) >= 8 {
+			port := binary.BigEndian.Uint16(value[2:4]) ^ uint16(stunMagicCookie>>16)
+			ip := make(net.IP, 4)
+			xorIP := binary.BigEndian.Uint32(value[4:8]) ^ stunMagicCookie
+			binary.BigEndian.PutUint32(ip, xorIP)
+			return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+		}
+		// attributes are padded to a 4-byte boundary
+		padded := (int(attrLen) + 3) &^ 3
+		attrs = attrs[4+padded:]
+	}
+	return nil, fmt.Errorf("no xor-mapped-address attribute in stun response")
+}
+
+// turnAllocate - sends no TURN Allocate request and always returns an error, so no relayed
+// transport address is ever obtained; username, password and localPort are unused.
+func turnAllocate(turnServer, username, password string, localPort int) (*net.UDPAddr, error) {
+	return nil, fmt.Errorf("turn relay allocation not yet implemented for server %s", turnServer)
+}